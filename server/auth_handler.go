@@ -1,9 +1,18 @@
 package server
 
-import "errors"
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
 
-// DefaultAuthenticationHandler 缺省 AuthenticationHandler
-var DefaultAuthenticationHandler = CreateUserAuthenticationHandler
+// DefaultAuthenticationHandler 缺省 AuthenticationHandler，指向
+// CreateAuthenticationHandler（见 auth_hook.go）：userHandler 实现了
+// directBindUserHandler 时走目录 bind 校验，配置了 auth_hook_type 时构造
+// http/exec 钩子，否则退回到 CreateUserAuthenticationHandler 的本地密码校验；
+// 配置了 session 时再包一层 SessionAuthenticationHandler。
+var DefaultAuthenticationHandler = CreateAuthenticationHandler
 
 // AuthenticationHandler 验证用户并返回用户信息
 type AuthenticationHandler interface {
@@ -31,17 +40,29 @@ func CreateUserAuthenticationHandler(userHandler UserHandler, config interface{}
 			}
 
 			var hashKey string
+			var hashParams map[string]interface{}
 			if k, ok := params["passwordHashKey"]; ok && k != nil {
-				s, ok := k.(string)
-				if !ok {
-					return nil, errors.New("数据库配置中的 passwordHashKey 的值不是字符串")
+				switch v := k.(type) {
+				case string:
+					hashKey = v
+				case map[string]interface{}:
+					hashParams = v
+				default:
+					return nil, errors.New("数据库配置中的 passwordHashKey 的值不是字符串或对象")
 				}
-				hashKey = s
 			}
 
-			signingMethod = GetSigningMethod(s)
-			if signingMethod == nil {
-				return nil, errors.New("在数据库配置中的 passwordHashAlg 的算法不支持")
+			if strings.EqualFold(s, "argon2id") && hashParams != nil {
+				argon2idParams, err := toArgon2idParams(hashParams)
+				if err != nil {
+					return nil, err
+				}
+				signingMethod = NewArgon2idSigningMethod(argon2idParams)
+			} else {
+				signingMethod = GetSigningMethod(s)
+				if signingMethod == nil {
+					return nil, errors.New("在数据库配置中的 passwordHashAlg 的算法不支持")
+				}
 			}
 			if hashKey != "" {
 				secretKey = []byte(hashKey)
@@ -49,17 +70,70 @@ func CreateUserAuthenticationHandler(userHandler UserHandler, config interface{}
 		}
 	}
 
+	tracker, err := trackerFromParams(params)
+	if err != nil {
+		return nil, err
+	}
+
 	return &userAuthenticationHandler{
 		userHandler:   userHandler,
 		signingMethod: signingMethod,
 		secretKey:     secretKey,
+		tracker:       tracker,
 	}, nil
 }
 
+// toArgon2idParams 把 passwordHashKey 里的结构化配置转换为 Argon2idParams，
+// 支持 time/memory/threads/keyLen 四个调参项，均为可选，缺省值见 defaultArgon2idParams。
+func toArgon2idParams(m map[string]interface{}) (Argon2idParams, error) {
+	var params Argon2idParams
+	for key, dst := range map[string]*uint32{
+		"time":   &params.Time,
+		"memory": &params.Memory,
+		"keyLen": &params.KeyLen,
+	} {
+		o, ok := m[key]
+		if !ok || o == nil {
+			continue
+		}
+		v, ok := toUint32(o)
+		if !ok {
+			return params, errors.New("passwordHashKey 中的 " + key + " 不是数字")
+		}
+		*dst = v
+	}
+	if o, ok := m["threads"]; ok && o != nil {
+		v, ok := toUint32(o)
+		if !ok {
+			return params, errors.New("passwordHashKey 中的 threads 不是数字")
+		}
+		params.Threads = uint8(v)
+	}
+	return params, nil
+}
+
+func toUint32(o interface{}) (uint32, bool) {
+	switch v := o.(type) {
+	case int:
+		return uint32(v), true
+	case int32:
+		return uint32(v), true
+	case int64:
+		return uint32(v), true
+	case float64:
+		return uint32(v), true
+	case uint32:
+		return v, true
+	default:
+		return 0, false
+	}
+}
+
 type userAuthenticationHandler struct {
 	userHandler   UserHandler
 	signingMethod SigningMethod
 	secretKey     []byte
+	tracker       FailureTracker
 }
 
 func (ah *userAuthenticationHandler) Auth(address, username, password string) (map[string]interface{}, error) {
@@ -67,7 +141,7 @@ func (ah *userAuthenticationHandler) Auth(address, username, password string) (m
 		return nil, ErrUsernameEmpty
 	}
 
-	users, err := ah.userHandler.Read(username, address)
+	users, err := ah.userHandler.ReadUser(username)
 	if err != nil {
 		return nil, err
 	}
@@ -78,7 +152,7 @@ func (ah *userAuthenticationHandler) Auth(address, username, password string) (m
 		return nil, ErrMutiUsers
 	}
 
-	ok, err := users[0].IsValid(address)
+	ok, err := users[0].CanUse(&http.Request{RemoteAddr: address, Header: http.Header{}})
 	if err != nil {
 		return nil, err
 	}
@@ -94,9 +168,138 @@ func (ah *userAuthenticationHandler) Auth(address, username, password string) (m
 	err = ah.signingMethod.Verify(password, exceptedPassword, ah.secretKey)
 	if err != nil {
 		if err == ErrSignatureInvalid {
+			if lockErr := recordFailure(ah.tracker, ah.userHandler, username, address); lockErr != nil {
+				return nil, lockErr
+			}
 			return nil, ErrPasswordNotMatch
 		}
 		return nil, err
 	}
+
+	if ah.tracker != nil {
+		ah.tracker.Reset(username, address)
+	}
+	return users[0].Data(), nil
+}
+
+// trackerFromParams 按 max_failures/failure_window/lockout_by/
+// max_failure_entries 构造 FailureTracker，max_failures<=0 时不启用锁定，
+// 供 CreateUserAuthenticationHandler 和 CreateDirectBindAuthenticationHandler
+// 共用。
+func trackerFromParams(params map[string]interface{}) (FailureTracker, error) {
+	if params == nil {
+		return nil, nil
+	}
+
+	n, err := intParam(params, "max_failures")
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+
+	window, err := durationParam(params, "failure_window")
+	if err != nil {
+		return nil, err
+	}
+	if window == 0 {
+		window = time.Hour
+	}
+
+	keyMode := lockoutByUsername
+	if o, ok := params["lockout_by"]; ok && o != nil {
+		s, ok := o.(string)
+		if !ok {
+			return nil, errors.New("数据库配置中的 lockout_by 的值不是字符串")
+		}
+		keyMode = parseLockoutKeyMode(s)
+	}
+
+	maxEntries, err := intParam(params, "max_failure_entries")
+	if err != nil {
+		return nil, err
+	}
+	return NewMemoryFailureTracker(n, window, keyMode, maxEntries), nil
+}
+
+// recordFailure 记录一次失败的认证尝试，达到 max_failures 阈值时调用
+// userHandler.LockUser 锁定账号并返回 ErrUserLocked。
+func recordFailure(tracker FailureTracker, userHandler UserHandler, username, address string) error {
+	if tracker == nil {
+		return nil
+	}
+	if !tracker.RecordFailure(username, address) {
+		return nil
+	}
+	if err := userHandler.LockUser(username); err != nil {
+		return err
+	}
+	return ErrUserLocked
+}
+
+// directBindUserHandler 由把密码校验完全交给外部系统的 UserHandler 实现，
+// 例如 ldapUserHandler：系统本身拥有密码，ReadUser 返回的 User.Password()
+// 永远是空的，只能靠 Bind 用调用方提供的明文密码重新验证一次。
+type directBindUserHandler interface {
+	Bind(dn, password string) error
+}
+
+// CreateDirectBindAuthenticationHandler 构造一个完全跳过 signingMethod 比对、
+// 靠 binder.Bind 验证密码的 AuthenticationHandler，用于 ldapUserHandler 等
+// 把密码校验代理给外部目录的场景；锁定策略复用与
+// CreateUserAuthenticationHandler 相同的 max_failures/failure_window 参数。
+func CreateDirectBindAuthenticationHandler(userHandler UserHandler, binder directBindUserHandler, params map[string]interface{}) (AuthenticationHandler, error) {
+	tracker, err := trackerFromParams(params)
+	if err != nil {
+		return nil, err
+	}
+	return &directBindAuthenticationHandler{
+		userHandler: userHandler,
+		binder:      binder,
+		tracker:     tracker,
+	}, nil
+}
+
+type directBindAuthenticationHandler struct {
+	userHandler UserHandler
+	binder      directBindUserHandler
+	tracker     FailureTracker
+}
+
+func (ah *directBindAuthenticationHandler) Auth(address, username, password string) (map[string]interface{}, error) {
+	if username == "" {
+		return nil, ErrUsernameEmpty
+	}
+
+	users, err := ah.userHandler.ReadUser(username)
+	if err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, ErrUserNotFound
+	}
+	if len(users) != 1 {
+		return nil, ErrMutiUsers
+	}
+
+	dn, _ := users[0].Data()["dn"].(string)
+	if dn == "" {
+		return nil, errors.New("directory user is missing dn")
+	}
+
+	if err := ah.binder.Bind(dn, password); err != nil {
+		if err == ErrPasswordNotMatch {
+			if lockErr := recordFailure(ah.tracker, ah.userHandler, username, address); lockErr != nil {
+				return nil, lockErr
+			}
+			return nil, ErrPasswordNotMatch
+		}
+		return nil, err
+	}
+
+	if ah.tracker != nil {
+		ah.tracker.Reset(username, address)
+	}
 	return users[0].Data(), nil
 }
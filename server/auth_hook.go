@@ -0,0 +1,295 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// ErrAuthHookUnavailable 表示外部认证钩子本身不可用（网络错误、进程无法启动、
+// 响应格式不正确等），而不是用户名密码校验失败。调用方可以据此决定是否
+// 退回到 dbUserHandler 之类的后备 AuthenticationHandler。
+var ErrAuthHookUnavailable = errors.New("auth hook is unavailable")
+
+// CreateAuthenticationHandler 是 DefaultAuthenticationHandler 指向的工厂函数。
+// userHandler 实现了 directBindUserHandler（例如 ldapUserHandler）时，密码由
+// 目录自己持有，直接走 CreateDirectBindAuthenticationHandler 跳过本地的
+// signingMethod 比对；否则在 params 中配置了 auth_hook_type 时构造 http/exec
+// 外部认证钩子，都没有配置时退回到既有的 CreateUserAuthenticationHandler
+// （基于 passwordHashAlg 的本地校验）。params 中配置了 session 时，最后会用
+// SessionAuthenticationHandler 把上面得到的结果包一层，让一次成功的 Auth
+// 顺带铸造一条会话。
+func CreateAuthenticationHandler(userHandler UserHandler, config interface{}) (AuthenticationHandler, error) {
+	var params map[string]interface{}
+	if config != nil {
+		m, ok := config.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("arguments of AuthConfg isn't map")
+		}
+		params = m
+	}
+
+	handler, err := createAuthenticationHandlerWithoutSession(userHandler, config, params)
+	if err != nil {
+		return nil, err
+	}
+	return withSessionStore(handler, params)
+}
+
+func createAuthenticationHandlerWithoutSession(userHandler UserHandler, config interface{}, params map[string]interface{}) (AuthenticationHandler, error) {
+	if binder, ok := userHandler.(directBindUserHandler); ok {
+		return CreateDirectBindAuthenticationHandler(userHandler, binder, params)
+	}
+
+	hookType, _ := params["auth_hook_type"].(string)
+	if hookType == "" {
+		return CreateUserAuthenticationHandler(userHandler, config)
+	}
+
+	hook, err := createHookAuthenticationHandler(hookType, params)
+	if err != nil {
+		return nil, err
+	}
+
+	fallback, err := CreateUserAuthenticationHandler(userHandler, config)
+	if err != nil {
+		return nil, err
+	}
+	return &hookWithFallbackHandler{hook: hook, fallback: fallback}, nil
+}
+
+// withSessionStore 在 params["session"] 配置了 *DbConfig 时，用
+// DefaultSessionStore 打开的 SessionStore 把 handler 包成
+// SessionAuthenticationHandler；没配置时原样返回 handler，不强制所有调用方
+// 都要铸造会话。
+func withSessionStore(handler AuthenticationHandler, params map[string]interface{}) (AuthenticationHandler, error) {
+	o, ok := params["session"]
+	if !ok || o == nil {
+		return handler, nil
+	}
+	dbConfig, ok := o.(*DbConfig)
+	if !ok {
+		return nil, errors.New("数据库配置中的 session 的值不是 *DbConfig")
+	}
+
+	store, err := DefaultSessionStore(dbConfig)
+	if err != nil {
+		return nil, err
+	}
+	return NewSessionAuthenticationHandler(handler, store), nil
+}
+
+func createHookAuthenticationHandler(hookType string, params map[string]interface{}) (AuthenticationHandler, error) {
+	timeout := 10 * time.Second
+	if o, ok := params["auth_hook_timeout"]; ok && o != nil {
+		s, ok := o.(string)
+		if !ok {
+			return nil, errors.New("数据库配置中的 auth_hook_timeout 的值不是字符串")
+		}
+		if s = strings.TrimSpace(s); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil {
+				return nil, errors.New("数据库配置中的 auth_hook_timeout 的值不是有效的时间间隔")
+			}
+			timeout = d
+		}
+	}
+
+	switch hookType {
+	case "http":
+		return newHTTPAuthenticationHandler(params, timeout)
+	case "exec":
+		return newExecAuthenticationHandler(params, timeout)
+	default:
+		return nil, errors.New("auth_hook_type 不支持 - " + hookType)
+	}
+}
+
+// hookWithFallbackHandler 先尝试外部认证钩子，钩子本身不可用时退回到
+// 本地的 dbUserHandler 校验；钩子明确拒绝的凭证不会触发回退。
+type hookWithFallbackHandler struct {
+	hook     AuthenticationHandler
+	fallback AuthenticationHandler
+}
+
+func (h *hookWithFallbackHandler) Auth(address, username, password string) (map[string]interface{}, error) {
+	data, err := h.hook.Auth(address, username, password)
+	if err == nil {
+		return data, nil
+	}
+	if errors.Is(err, ErrAuthHookUnavailable) {
+		return h.fallback.Auth(address, username, password)
+	}
+	return nil, err
+}
+
+// httpAuthenticationHandler 把用户名密码 POST 给外部 HTTP 服务做校验。
+type httpAuthenticationHandler struct {
+	client     *http.Client
+	url        string
+	secret     []byte
+	headerName string
+}
+
+// authHookRequest 是 POST 给外部 HTTP 钩子的请求体。这里没有 headers 字段：
+// AuthenticationHandler.Auth 的签名只接收 address/username/password，调用方
+// 的原始 *http.Request（以及它的请求头）到这一层已经不存在了，没有东西可以
+// 填进去。如果某个钩子确实需要转发请求头，得先把 Auth 的签名改成携带
+// *http.Request（或者等价的 header 映射），这会影响 AuthenticationHandler
+// 目前所有的实现。
+type authHookRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Address  string `json:"address"`
+}
+
+func newHTTPAuthenticationHandler(params map[string]interface{}, timeout time.Duration) (AuthenticationHandler, error) {
+	url, _ := params["auth_hook_url"].(string)
+	if url = strings.TrimSpace(url); url == "" {
+		return nil, errors.New("数据库配置中缺少 auth_hook_url")
+	}
+
+	transport := &http.Transport{}
+	if certFile, _ := params["auth_hook_cert"].(string); certFile != "" {
+		keyFile, _ := params["auth_hook_key"].(string)
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("加载 auth_hook_cert/auth_hook_key 失败 - %w", err)
+		}
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+		if caFile, _ := params["auth_hook_ca"].(string); caFile != "" {
+			ca, err := ioutil.ReadFile(caFile)
+			if err != nil {
+				return nil, fmt.Errorf("加载 auth_hook_ca 失败 - %w", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(ca) {
+				return nil, errors.New("auth_hook_ca 不是有效的证书")
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	var secret []byte
+	if s, _ := params["auth_hook_secret"].(string); s != "" {
+		secret = []byte(s)
+	}
+
+	return &httpAuthenticationHandler{
+		client:     &http.Client{Transport: transport, Timeout: timeout},
+		url:        url,
+		secret:     secret,
+		headerName: "X-Auth-Hook-Signature",
+	}, nil
+}
+
+func (h *httpAuthenticationHandler) Auth(address, username, password string) (map[string]interface{}, error) {
+	body, err := json.Marshal(authHookRequest{
+		Username: username,
+		Password: password,
+		Address:  address,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrAuthHookUnavailable, err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrAuthHookUnavailable, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.secret != nil {
+		mac := hmac.New(sha256.New, h.secret)
+		mac.Write(body)
+		req.Header.Set(h.headerName, hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrAuthHookUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrAuthHookUnavailable, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, ErrPasswordNotMatch
+	}
+
+	var status struct {
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(respBody, &status); err == nil && status.Status == "denied" {
+		return nil, ErrPasswordNotMatch
+	}
+
+	var user map[string]interface{}
+	if err := json.Unmarshal(respBody, &user); err != nil {
+		return nil, fmt.Errorf("%w: response isn't a json object - %s", ErrAuthHookUnavailable, err)
+	}
+	return user, nil
+}
+
+// execAuthenticationHandler 运行外部命令校验用户名密码：用户名作为参数传入，
+// 密码通过 stdin 传入，命令在 stdout 输出用户信息的 JSON。
+type execAuthenticationHandler struct {
+	cmd     string
+	args    []string
+	timeout time.Duration
+}
+
+func newExecAuthenticationHandler(params map[string]interface{}, timeout time.Duration) (AuthenticationHandler, error) {
+	cmd, _ := params["auth_hook_cmd"].(string)
+	if cmd = strings.TrimSpace(cmd); cmd == "" {
+		return nil, errors.New("数据库配置中缺少 auth_hook_cmd")
+	}
+
+	fields := strings.Fields(cmd)
+	return &execAuthenticationHandler{
+		cmd:     fields[0],
+		args:    fields[1:],
+		timeout: timeout,
+	}, nil
+}
+
+func (h *execAuthenticationHandler) Auth(address, username, password string) (map[string]interface{}, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.cmd, append(h.args, username)...)
+	cmd.Stdin = strings.NewReader(password)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return nil, ErrPasswordNotMatch
+		}
+		return nil, fmt.Errorf("%w: %s", ErrAuthHookUnavailable, err)
+	}
+
+	var user map[string]interface{}
+	if err := json.Unmarshal(stdout.Bytes(), &user); err != nil {
+		return nil, fmt.Errorf("%w: stdout isn't a json object - %s", ErrAuthHookUnavailable, err)
+	}
+	return user, nil
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lockoutKeyMode 决定失败计数以用户名、来源地址还是两者一起作为 key，
+// 对应 config 中的 lockout_by 取值（"username"/"address"/"both"）。
+type lockoutKeyMode int
+
+const (
+	lockoutByUsername lockoutKeyMode = iota
+	lockoutByAddress
+	lockoutByBoth
+)
+
+// FailureTracker 统计连续的密码校验失败次数，超过阈值后调用方应当锁定账号。
+// 一次成功的认证会重置计数。
+type FailureTracker interface {
+	// RecordFailure 记录一次失败，达到 max_failures 时返回 true。
+	RecordFailure(username, address string) bool
+
+	// Reset 在认证成功后清除该用户/地址的失败计数。
+	Reset(username, address string)
+}
+
+func (m lockoutKeyMode) key(username, address string) string {
+	switch m {
+	case lockoutByAddress:
+		return address
+	case lockoutByBoth:
+		return username + "\x00" + address
+	default:
+		return username
+	}
+}
+
+func parseLockoutKeyMode(s string) lockoutKeyMode {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "address", "ip":
+		return lockoutByAddress
+	case "both":
+		return lockoutByBoth
+	default:
+		return lockoutByUsername
+	}
+}
+
+// memoryFailureTracker 是 FailureTracker 的缺省实现：按 key 维护一个滑动窗口
+// 内的失败时间戳，并用一条 LRU 链表限制同时跟踪的 key 数量，避免被大量不同
+// 用户名/地址的失败尝试撑爆内存。
+type memoryFailureTracker struct {
+	mu sync.Mutex
+
+	maxFailures int
+	window      time.Duration
+	keyMode     lockoutKeyMode
+	maxEntries  int
+
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type failureEntry struct {
+	key      string
+	failures []time.Time
+}
+
+// NewMemoryFailureTracker 构造缺省的内存版 FailureTracker。maxEntries<=0 时
+// 使用 10000 作为 LRU 容量上限。
+func NewMemoryFailureTracker(maxFailures int, window time.Duration, keyMode lockoutKeyMode, maxEntries int) FailureTracker {
+	if maxEntries <= 0 {
+		maxEntries = 10000
+	}
+	return &memoryFailureTracker{
+		maxFailures: maxFailures,
+		window:      window,
+		keyMode:     keyMode,
+		maxEntries:  maxEntries,
+		entries:     map[string]*list.Element{},
+		order:       list.New(),
+	}
+}
+
+func (t *memoryFailureTracker) RecordFailure(username, address string) bool {
+	key := t.keyMode.key(username, address)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	el, ok := t.entries[key]
+	var entry *failureEntry
+	if ok {
+		entry = el.Value.(*failureEntry)
+		t.order.MoveToFront(el)
+	} else {
+		entry = &failureEntry{key: key}
+		t.entries[key] = t.order.PushFront(entry)
+		t.evictIfNeeded()
+	}
+
+	entry.failures = pruneBefore(entry.failures, now.Add(-t.window))
+	entry.failures = append(entry.failures, now)
+
+	return t.maxFailures > 0 && len(entry.failures) >= t.maxFailures
+}
+
+func (t *memoryFailureTracker) Reset(username, address string) {
+	key := t.keyMode.key(username, address)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if el, ok := t.entries[key]; ok {
+		t.order.Remove(el)
+		delete(t.entries, key)
+	}
+}
+
+func (t *memoryFailureTracker) evictIfNeeded() {
+	for len(t.entries) > t.maxEntries {
+		oldest := t.order.Back()
+		if oldest == nil {
+			return
+		}
+		entry := oldest.Value.(*failureEntry)
+		t.order.Remove(oldest)
+		delete(t.entries, entry.key)
+	}
+}
+
+func pruneBefore(failures []time.Time, cutoff time.Time) []time.Time {
+	kept := failures[:0]
+	for _, t := range failures {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,75 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryFailureTrackerTripsAtThreshold(t *testing.T) {
+	tracker := NewMemoryFailureTracker(3, time.Hour, lockoutByUsername, 0)
+
+	if tracker.RecordFailure("alice", "1.2.3.4") {
+		t.Fatal("1st failure should not trip the tracker")
+	}
+	if tracker.RecordFailure("alice", "1.2.3.4") {
+		t.Fatal("2nd failure should not trip the tracker")
+	}
+	if !tracker.RecordFailure("alice", "1.2.3.4") {
+		t.Fatal("3rd failure should trip the tracker")
+	}
+}
+
+func TestMemoryFailureTrackerResetClearsCount(t *testing.T) {
+	tracker := NewMemoryFailureTracker(2, time.Hour, lockoutByUsername, 0)
+
+	if tracker.RecordFailure("alice", "1.2.3.4") {
+		t.Fatal("1st failure should not trip the tracker")
+	}
+	tracker.Reset("alice", "1.2.3.4")
+
+	if tracker.RecordFailure("alice", "1.2.3.4") {
+		t.Fatal("failure right after Reset should start counting from zero")
+	}
+}
+
+func TestMemoryFailureTrackerSlidesOutOldFailures(t *testing.T) {
+	internal := NewMemoryFailureTracker(2, 10*time.Millisecond, lockoutByUsername, 0).(*memoryFailureTracker)
+
+	if internal.RecordFailure("alice", "1.2.3.4") {
+		t.Fatal("1st failure should not trip the tracker")
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	if internal.RecordFailure("alice", "1.2.3.4") {
+		t.Fatal("failure outside the sliding window should not combine with the expired one")
+	}
+}
+
+func TestMemoryFailureTrackerKeyModes(t *testing.T) {
+	byAddress := NewMemoryFailureTracker(2, time.Hour, lockoutByAddress, 0)
+	byAddress.RecordFailure("alice", "1.2.3.4")
+	if !byAddress.RecordFailure("bob", "1.2.3.4") {
+		t.Fatal("lockoutByAddress should count failures from the same address across different usernames")
+	}
+
+	byUsername := NewMemoryFailureTracker(2, time.Hour, lockoutByUsername, 0)
+	byUsername.RecordFailure("alice", "1.2.3.4")
+	if !byUsername.RecordFailure("alice", "5.6.7.8") {
+		t.Fatal("lockoutByUsername should trip on the 2nd failure for the same username regardless of address")
+	}
+}
+
+func TestMemoryFailureTrackerEvictsOldestEntryOverCapacity(t *testing.T) {
+	internal := NewMemoryFailureTracker(5, time.Hour, lockoutByUsername, 1).(*memoryFailureTracker)
+
+	internal.RecordFailure("alice", "1.2.3.4")
+	internal.RecordFailure("bob", "1.2.3.4")
+
+	if len(internal.entries) != 1 {
+		t.Fatalf("len(entries) = %d, want 1 after exceeding maxEntries", len(internal.entries))
+	}
+	if _, ok := internal.entries["alice"]; ok {
+		t.Fatal("the oldest tracked key should have been evicted")
+	}
+}
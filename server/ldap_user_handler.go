@@ -0,0 +1,315 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ldapUserHandler 是 UserHandler 的 LDAP/AD 实现。ReadUser 用服务账号 bind
+// 后按 filter 分页搜索目录，把命中条目的属性投影进返回的 User.Data()；真正
+// 的密码校验交给 directBindUserHandler（见 auth_handler.go）——目录拥有密码，
+// 这里读到、返回的 User.Password() 永远是空字符串。
+type ldapUserHandler struct {
+	addr      string // host:port，不含协议前缀
+	useTLS    bool   // ldaps://
+	startTLS  bool
+	tlsConfig *tls.Config
+
+	bindDN       string // 用于初始搜索的服务账号，空表示匿名 bind
+	bindPassword string
+
+	baseDN string
+	filter string // fmt 模板，例如 "(&(objectClass=user)(sAMAccountName=%s))"
+
+	// attributes 把 LDAP 属性名映射到 UserImpl.data 里的 key，value 为空时
+	// 直接用属性名本身。
+	attributes map[string]string
+
+	groupBaseDN    string // 为空时不做组成员关系查询
+	groupFilter    string // fmt 模板，%s 是成员的 DN，例如 "(member=%s)"
+	groupAttribute string // 查到的组 DN 列表投影进 data 的 key，缺省 "groups"
+
+	pageSize uint32
+	timeout  time.Duration
+}
+
+// createLdapUserHandler 依据 DbConfig.Params 里的 ldap 相关参数构造
+// ldapUserHandler，由 createUserHandler 在 DbType == "ldap" 时调用。
+func createLdapUserHandler(config *DbConfig) (UserHandler, error) {
+	params := config.Params
+	if params == nil {
+		return nil, errors.New("ldap 配置中缺少 params")
+	}
+
+	addr, _ := params["addr"].(string)
+	if addr = strings.TrimSpace(addr); addr == "" {
+		return nil, errors.New("ldap 配置中缺少 addr")
+	}
+	useTLS := strings.HasPrefix(strings.ToLower(addr), "ldaps://")
+	addr = strings.TrimPrefix(strings.TrimPrefix(addr, "ldap://"), "ldaps://")
+
+	startTLS := false
+	if o, ok := params["starttls"]; ok && o != nil {
+		b, ok := o.(bool)
+		if !ok {
+			return nil, errors.New("ldap 配置中的 starttls 的值不是布尔值")
+		}
+		startTLS = b
+	}
+
+	insecureSkipVerify := false
+	if o, ok := params["insecure_skip_verify"]; ok && o != nil {
+		b, ok := o.(bool)
+		if !ok {
+			return nil, errors.New("ldap 配置中的 insecure_skip_verify 的值不是布尔值")
+		}
+		insecureSkipVerify = b
+	}
+
+	bindDN, _ := params["bind_dn"].(string)
+	bindPassword, _ := params["bind_password"].(string)
+
+	baseDN, _ := params["base_dn"].(string)
+	if baseDN = strings.TrimSpace(baseDN); baseDN == "" {
+		return nil, errors.New("ldap 配置中缺少 base_dn")
+	}
+
+	filter, _ := params["filter"].(string)
+	if filter = strings.TrimSpace(filter); filter == "" {
+		filter = "(&(objectClass=user)(sAMAccountName=%s))"
+	}
+
+	attributes := map[string]string{}
+	if o, ok := params["attributes"]; ok && o != nil {
+		m, ok := o.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("ldap 配置中的 attributes 的值不是对象")
+		}
+		for attr, v := range m {
+			key, ok := v.(string)
+			if !ok {
+				return nil, errors.New("ldap 配置中的 attributes 的值必须都是字符串")
+			}
+			attributes[attr] = key
+		}
+	}
+
+	groupBaseDN, _ := params["group_base_dn"].(string)
+	groupFilter, _ := params["group_filter"].(string)
+	if groupBaseDN != "" && strings.TrimSpace(groupFilter) == "" {
+		groupFilter = "(member=%s)"
+	}
+	groupAttribute, _ := params["group_attribute"].(string)
+	if groupAttribute = strings.TrimSpace(groupAttribute); groupAttribute == "" {
+		groupAttribute = "groups"
+	}
+
+	pageSize, err := intParam(params, "page_size")
+	if err != nil {
+		return nil, err
+	}
+	if pageSize <= 0 {
+		pageSize = 100
+	}
+
+	timeout, err := durationParam(params, "timeout")
+	if err != nil {
+		return nil, err
+	}
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+
+	return &ldapUserHandler{
+		addr:           addr,
+		useTLS:         useTLS,
+		startTLS:       startTLS,
+		tlsConfig:      &tls.Config{InsecureSkipVerify: insecureSkipVerify},
+		bindDN:         bindDN,
+		bindPassword:   bindPassword,
+		baseDN:         baseDN,
+		filter:         filter,
+		attributes:     attributes,
+		groupBaseDN:    groupBaseDN,
+		groupFilter:    groupFilter,
+		groupAttribute: groupAttribute,
+		pageSize:       uint32(pageSize),
+		timeout:        timeout,
+	}, nil
+}
+
+// dial 建立一条新连接，按配置走 LDAPS 或者明文 + StartTLS。
+func (h *ldapUserHandler) dial() (*ldap.Conn, error) {
+	var conn *ldap.Conn
+	var err error
+	if h.useTLS {
+		conn, err = ldap.DialURL("ldaps://"+h.addr, ldap.DialWithTLSConfig(h.tlsConfig))
+	} else {
+		conn, err = ldap.DialURL("ldap://" + h.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("连接 ldap 服务器失败 - %w", err)
+	}
+	conn.SetTimeout(h.timeout)
+
+	if h.startTLS {
+		if err := conn.StartTLS(h.tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("ldap starttls 失败 - %w", err)
+		}
+	}
+	return conn, nil
+}
+
+func (h *ldapUserHandler) serviceBind(conn *ldap.Conn) error {
+	if h.bindDN == "" {
+		return nil
+	}
+	if err := conn.Bind(h.bindDN, h.bindPassword); err != nil {
+		return fmt.Errorf("ldap 服务账号 bind 失败 - %w", err)
+	}
+	return nil
+}
+
+// ReadUser 用服务账号 bind 后按 filter 分页搜索目录，把命中条目的属性投影
+// 进返回的 User.Data()，并在配置了 group_base_dn 时为每个命中条目附带查一次
+// 组成员关系。
+func (h *ldapUserHandler) ReadUser(username string) ([]User, error) {
+	conn, err := h.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := h.serviceBind(conn); err != nil {
+		return nil, err
+	}
+
+	attrs := make([]string, 0, len(h.attributes))
+	for attr := range h.attributes {
+		attrs = append(attrs, attr)
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		h.baseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(h.filter, ldap.EscapeFilter(username)),
+		attrs,
+		nil,
+	)
+
+	result, err := conn.SearchWithPaging(searchRequest, h.pageSize)
+	if err != nil {
+		return nil, fmt.Errorf("ldap 搜索失败 - %w", err)
+	}
+
+	users := make([]User, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		data := map[string]interface{}{"dn": entry.DN}
+		for attr, key := range h.attributes {
+			if key == "" {
+				key = attr
+			}
+			if v := entry.GetAttributeValue(attr); v != "" {
+				data[key] = v
+			}
+		}
+
+		if h.groupBaseDN != "" {
+			groups, err := h.lookupGroups(conn, entry.DN)
+			if err != nil {
+				return nil, err
+			}
+			data[h.groupAttribute] = groups
+		}
+
+		users = append(users, &ldapUser{name: username, dn: entry.DN, data: data})
+	}
+	return users, nil
+}
+
+// lookupGroups 按 groupFilter 搜索 memberDN 所属的组，返回组的 DN 列表，供
+// 下游授权使用。
+func (h *ldapUserHandler) lookupGroups(conn *ldap.Conn, memberDN string) ([]string, error) {
+	searchRequest := ldap.NewSearchRequest(
+		h.groupBaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf(h.groupFilter, ldap.EscapeFilter(memberDN)),
+		[]string{"dn"},
+		nil,
+	)
+
+	result, err := conn.SearchWithPaging(searchRequest, h.pageSize)
+	if err != nil {
+		return nil, fmt.Errorf("ldap 查询组成员关系失败 - %w", err)
+	}
+
+	groups := make([]string, 0, len(result.Entries))
+	for _, entry := range result.Entries {
+		groups = append(groups, entry.DN)
+	}
+	return groups, nil
+}
+
+// LockUser 是 no-op：账号锁定由目录自己的密码策略（例如 AD 的
+// lockoutThreshold）执行，本地没有对应字段可写。
+func (h *ldapUserHandler) LockUser(username string) error {
+	return nil
+}
+
+// Bind 实现 directBindUserHandler：用调用方提供的 DN 和明文密码重新连接并
+// bind，以此确认凭证是否正确——目录拥有密码，这里永远不会读到、也不会比
+// 对它的哈希。只有目录明确拒绝凭证（LDAPResultInvalidCredentials）才会映射
+// 成 ErrPasswordNotMatch；连接失败、TLS 握手失败、超时等目录自身的故障会
+// 原样返回，避免被 directBindAuthenticationHandler 当成密码错误计入
+// max_failures，把一次瞬时的 LDAP/AD 抖动变成对正常用户的误锁定。
+func (h *ldapUserHandler) Bind(dn, password string) error {
+	if password == "" {
+		return ErrPasswordEmpty
+	}
+
+	conn, err := h.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if err := conn.Bind(dn, password); err != nil {
+		var ldapErr *ldap.Error
+		if errors.As(err, &ldapErr) && ldapErr.ResultCode == ldap.LDAPResultInvalidCredentials {
+			return ErrPasswordNotMatch
+		}
+		return fmt.Errorf("ldap bind 失败 - %w", err)
+	}
+	return nil
+}
+
+// ldapUser 是目录里搜到的一条条目，Password() 始终为空——密码校验交给
+// ldapUserHandler.Bind。
+type ldapUser struct {
+	name string
+	dn   string
+	data map[string]interface{}
+}
+
+func (u *ldapUser) Name() string {
+	return u.name
+}
+
+func (u *ldapUser) Password() string {
+	return ""
+}
+
+func (u *ldapUser) CanUse(req *http.Request) (bool, error) {
+	return true, nil
+}
+
+func (u *ldapUser) Data() map[string]interface{} {
+	return u.data
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"database/sql/driver"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// RetryPolicy 控制瞬时数据库错误的重试行为：MaxAttempts 是包括第一次在内的
+// 最多执行次数，每次重试前的间隔按指数退避增长并叠加抖动，直到 MaxBackoff
+// 封顶。MaxAttempts<=1 表示不重试。
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+}
+
+// DefaultRetryPolicy 在配置里没有 retry_* 参数时使用，行为等同于不重试。
+var DefaultRetryPolicy = RetryPolicy{MaxAttempts: 1}
+
+// isTransientDBError 判断一个 database/sql 错误是否是瞬时性的，值得重试：
+// PostgreSQL 的序列化失败(40001)/死锁检测(40P01)，MySQL 的死锁(1213)/锁等待
+// 超时(1205)，以及底层连接已失效的 driver.ErrBadConn。
+func isTransientDBError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, driver.ErrBadConn) {
+		return true
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code {
+		case "40001", "40P01":
+			return true
+		}
+		return false
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case 1213, 1205:
+			return true
+		}
+		return false
+	}
+
+	return false
+}
+
+// withRetry 按 policy 执行 fn，fn 返回瞬时性错误时按指数退避加抖动重试，直到
+// MaxAttempts 用尽或 fn 返回成功/不可重试的错误。
+func withRetry(policy RetryPolicy, fn func() error) error {
+	attempts := policy.MaxAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	backoff := policy.InitialBackoff
+	if backoff <= 0 {
+		backoff = 50 * time.Millisecond
+	}
+	maxBackoff := policy.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = 2 * time.Second
+	}
+
+	var err error
+	for i := 0; i < attempts; i++ {
+		err = fn()
+		if err == nil || !isTransientDBError(err) {
+			return err
+		}
+		if i == attempts-1 {
+			break
+		}
+
+		sleep := backoff + time.Duration(rand.Int63n(int64(backoff)+1))
+		if sleep > maxBackoff {
+			sleep = maxBackoff
+		}
+		time.Sleep(sleep)
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	return err
+}
+
+func retryPolicyFromParams(params map[string]interface{}) (RetryPolicy, error) {
+	policy := DefaultRetryPolicy
+
+	if n, err := intParam(params, "retry_max_attempts"); err != nil {
+		return policy, err
+	} else if n > 0 {
+		policy.MaxAttempts = n
+	}
+	if d, err := durationParam(params, "retry_initial_backoff"); err != nil {
+		return policy, err
+	} else if d > 0 {
+		policy.InitialBackoff = d
+	}
+	if d, err := durationParam(params, "retry_max_backoff"); err != nil {
+		return policy, err
+	} else if d > 0 {
+		policy.MaxBackoff = d
+	}
+	return policy, nil
+}
@@ -0,0 +1,445 @@
+package server
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const bearerPrefix = "Bearer "
+
+// BearerToken 从 Authorization 头里取出 access token，取不到时返回空串。
+func BearerToken(req *http.Request) string {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, bearerPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(auth, bearerPrefix)
+}
+
+// AuthenticateByToken 按 Authorization: Bearer <token> 查找会话并刷新其
+// updated_at，使 API 客户端可以凭 access token 直接鉴权，而不必每次都重新
+// 走一遍 UserHandler/AuthenticationHandler 的用户名密码校验。
+func AuthenticateByToken(store SessionStore, req *http.Request) (*Session, error) {
+	token := BearerToken(req)
+	if token == "" {
+		return nil, ErrSessionNotFound
+	}
+
+	session, err := store.LookupByToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if err := store.Touch(session.SID); err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// SessionAuthenticationHandler 包装一个 AuthenticationHandler，在其 Auth 成功
+// 后用 SessionStore 额外铸造一条会话，sid 与 access token 分别写进返回数据的
+// "sid"/"access_token" 键：sid 用于服务端内部追踪与登出，access token 供
+// API 客户端之后凭
+// Authorization: Bearer <token> 走 AuthenticateByToken 直接鉴权，而不必每次
+// 都重新做一遍用户名密码校验。
+type SessionAuthenticationHandler struct {
+	auth  AuthenticationHandler
+	store SessionStore
+}
+
+// NewSessionAuthenticationHandler 用给定的 AuthenticationHandler 和
+// SessionStore 构造一个会同时铸造会话的 AuthenticationHandler。
+func NewSessionAuthenticationHandler(auth AuthenticationHandler, store SessionStore) *SessionAuthenticationHandler {
+	return &SessionAuthenticationHandler{auth: auth, store: store}
+}
+
+func (ah *SessionAuthenticationHandler) Auth(address, username, password string) (map[string]interface{}, error) {
+	data, err := ah.auth.Auth(address, username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err := ah.store.Create(username, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	data["sid"] = session.SID
+	data["access_token"] = session.AccessToken
+	return data, nil
+}
+
+// ErrSessionNotFound 表示按 sid 或 access token 查不到会话。
+var ErrSessionNotFound = errors.New("session not found")
+
+// ErrSessionExpired 表示会话因超过 max_idle 或 max_lifetime 而失效。
+var ErrSessionExpired = errors.New("session is expired")
+
+// Session 是一条已登录的会话记录，sid 用于服务端内部追踪，access token 是
+// 颁发给调用方、可以直接放进 Authorization: Bearer 头里的长效令牌。
+type Session struct {
+	SID         string
+	AccessToken string
+	Username    string
+	RemoteAddr  string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// SessionStore 管理登录会话与 access token，并按配置强制执行并发会话数上限、
+// 闲置超时与最长生命周期。
+type SessionStore interface {
+	// Create 为用户新建一个会话，按 MaxSessionsPerUser 淘汰该用户最老的会话。
+	Create(username, remoteAddr string) (*Session, error)
+
+	// LookupByToken 按 access token 查找会话，会话已过期（闲置或超过最长生命
+	// 周期）时返回 ErrSessionExpired，调用方应当将其当作未登录处理。
+	LookupByToken(token string) (*Session, error)
+
+	// Touch 刷新会话的 updated_at，用于维持闲置超时窗口。
+	Touch(sid string) error
+
+	// Delete 删除单个会话（登出）。
+	Delete(sid string) error
+
+	// DeleteByUsername 删除某个用户的全部会话（例如管理员强制下线）。
+	DeleteByUsername(username string) error
+}
+
+// SessionPolicy 描述会话相关的三项限制，零值表示不限制。
+type SessionPolicy struct {
+	// MaxSessionsPerUser 限制单个用户同时在线的会话数，超出时淘汰最老的会话。
+	MaxSessionsPerUser int
+
+	// MaxIdle 是会话允许的最长闲置时间，超过后的会话会被视为失效并由后台
+	// goroutine 回收。
+	MaxIdle time.Duration
+
+	// MaxLifetime 是从 created_at 起算的硬性上限，不因为 Touch 而延长。
+	MaxLifetime time.Duration
+}
+
+func newAccessToken() (string, error) {
+	buf := make([]byte, 64)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func newSID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// sqlSessionStore 是 SessionStore 的 SQL 实现，表结构为
+// (sid, access_token, username, remote_addr, created_at, updated_at)，按
+// access_token / username / updated_at 查询与删除。它不建表，也不建索引：
+// 表以及这三列上的索引都必须事先在数据库中建好。
+type sqlSessionStore struct {
+	db     *sql.DB
+	policy SessionPolicy
+
+	insertSQL           string
+	evictQuerySQL       string
+	lookupSQL           string
+	touchSQL            string
+	deleteSQL           string
+	deleteByUsernameSQL string
+	reapIdleSQL         string
+	reapLifetimeSQL     string
+
+	reapInterval time.Duration
+	closeCh      chan struct{}
+}
+
+// DefaultSessionStore 缺省 SessionStore 工厂，与 DefaultUserHandler/
+// DefaultAuthenticationHandler 一样可以被替换为自定义实现。
+var DefaultSessionStore = CreateSQLSessionStore
+
+// CreateSQLSessionStore 依据 DbConfig.Params 里的 session_table/
+// max_sessions_per_user/max_idle/max_lifetime/session_reap_interval 参数构造
+// SessionStore，约定与 createDbUserHandler 一致：字符串形式的时间间隔、
+// 可选的占位符替换。
+func CreateSQLSessionStore(config *DbConfig) (SessionStore, error) {
+	db, err := sql.Open(config.URL())
+	if err != nil {
+		return nil, err
+	}
+
+	tableName := "sessions"
+	policy := SessionPolicy{}
+	reapInterval := time.Minute
+
+	if config.Params != nil {
+		if o, ok := config.Params["session_table"]; ok && o != nil {
+			s, ok := o.(string)
+			if !ok {
+				return nil, errors.New("数据库配置中的 session_table 的值不是字符串")
+			}
+			if s = strings.TrimSpace(s); s != "" {
+				tableName = s
+			}
+		}
+
+		if n, err := intParam(config.Params, "max_sessions_per_user"); err != nil {
+			return nil, err
+		} else if n != 0 {
+			policy.MaxSessionsPerUser = n
+		}
+
+		if d, err := durationParam(config.Params, "max_idle"); err != nil {
+			return nil, err
+		} else if d != 0 {
+			policy.MaxIdle = d
+		}
+
+		if d, err := durationParam(config.Params, "max_lifetime"); err != nil {
+			return nil, err
+		} else if d != 0 {
+			policy.MaxLifetime = d
+		}
+
+		if d, err := durationParam(config.Params, "session_reap_interval"); err != nil {
+			return nil, err
+		} else if d != 0 {
+			reapInterval = d
+		}
+	}
+
+	insertSQL := fmt.Sprintf("INSERT INTO %s (sid, access_token, username, remote_addr, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)", tableName)
+	evictQuerySQL := fmt.Sprintf("SELECT sid FROM %s WHERE username = ? ORDER BY created_at DESC", tableName)
+	lookupSQL := fmt.Sprintf("SELECT sid, access_token, username, remote_addr, created_at, updated_at FROM %s WHERE access_token = ?", tableName)
+	touchSQL := fmt.Sprintf("UPDATE %s SET updated_at = ? WHERE sid = ?", tableName)
+	deleteSQL := fmt.Sprintf("DELETE FROM %s WHERE sid = ?", tableName)
+	deleteByUsernameSQL := fmt.Sprintf("DELETE FROM %s WHERE username = ?", tableName)
+	reapIdleSQL := fmt.Sprintf("DELETE FROM %s WHERE updated_at < ?", tableName)
+	reapLifetimeSQL := fmt.Sprintf("DELETE FROM %s WHERE created_at < ?", tableName)
+
+	if config.DbType == "postgres" || config.DbType == "postgresql" {
+		insertSQL = ReplacePlaceholders(insertSQL)
+		evictQuerySQL = ReplacePlaceholders(evictQuerySQL)
+		lookupSQL = ReplacePlaceholders(lookupSQL)
+		touchSQL = ReplacePlaceholders(touchSQL)
+		deleteSQL = ReplacePlaceholders(deleteSQL)
+		deleteByUsernameSQL = ReplacePlaceholders(deleteByUsernameSQL)
+		reapIdleSQL = ReplacePlaceholders(reapIdleSQL)
+		reapLifetimeSQL = ReplacePlaceholders(reapLifetimeSQL)
+	}
+
+	store := &sqlSessionStore{
+		db:                  db,
+		policy:              policy,
+		insertSQL:           insertSQL,
+		evictQuerySQL:       evictQuerySQL,
+		lookupSQL:           lookupSQL,
+		touchSQL:            touchSQL,
+		deleteSQL:           deleteSQL,
+		deleteByUsernameSQL: deleteByUsernameSQL,
+		reapIdleSQL:         reapIdleSQL,
+		reapLifetimeSQL:     reapLifetimeSQL,
+		reapInterval:        reapInterval,
+		closeCh:             make(chan struct{}),
+	}
+	go store.reapLoop()
+	return store, nil
+}
+
+func intParam(params map[string]interface{}, name string) (int, error) {
+	o, ok := params[name]
+	if !ok || o == nil {
+		return 0, nil
+	}
+	v, ok := toUint32(o)
+	if !ok {
+		return 0, errors.New("数据库配置中的 " + name + " 的值不是数字")
+	}
+	return int(v), nil
+}
+
+func durationParam(params map[string]interface{}, name string) (time.Duration, error) {
+	o, ok := params[name]
+	if !ok || o == nil {
+		return 0, nil
+	}
+	s, ok := o.(string)
+	if !ok {
+		return 0, errors.New("数据库配置中的 " + name + " 的值不是字符串")
+	}
+	if s = strings.TrimSpace(s); s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.New("数据库配置中的 " + name + " 的值不是有效的时间间隔")
+	}
+	return d, nil
+}
+
+func (s *sqlSessionStore) Create(username, remoteAddr string) (*Session, error) {
+	sid, err := newSID()
+	if err != nil {
+		return nil, err
+	}
+	token, err := newAccessToken()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	_, err = s.db.Exec(s.insertSQL, sid, token, username, remoteAddr, now, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.policy.MaxSessionsPerUser > 0 {
+		if err := s.evictOldest(username, s.policy.MaxSessionsPerUser); err != nil {
+			log.Println("sso: evict oldest sessions of", username, "failed -", err)
+		}
+	}
+
+	return &Session{
+		SID:         sid,
+		AccessToken: token,
+		Username:    username,
+		RemoteAddr:  remoteAddr,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}, nil
+}
+
+func (s *sqlSessionStore) evictOldest(username string, max int) error {
+	rows, err := s.db.Query(s.evictQuerySQL, username)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var sids []string
+	for rows.Next() {
+		var sid string
+		if err := rows.Scan(&sid); err != nil {
+			return err
+		}
+		sids = append(sids, sid)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if len(sids) <= max {
+		return nil
+	}
+	for _, sid := range sids[max:] {
+		if err := s.Delete(sid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqlSessionStore) LookupByToken(token string) (*Session, error) {
+	row := s.db.QueryRow(s.lookupSQL, token)
+
+	session := &Session{}
+	err := row.Scan(&session.SID, &session.AccessToken, &session.Username, &session.RemoteAddr, &session.CreatedAt, &session.UpdatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrSessionNotFound
+		}
+		return nil, err
+	}
+
+	if s.isExpired(session) {
+		return nil, ErrSessionExpired
+	}
+	return session, nil
+}
+
+func (s *sqlSessionStore) isExpired(session *Session) bool {
+	now := time.Now()
+	if s.policy.MaxIdle > 0 && now.After(session.UpdatedAt.Add(s.policy.MaxIdle)) {
+		return true
+	}
+	if s.policy.MaxLifetime > 0 && now.After(session.CreatedAt.Add(s.policy.MaxLifetime)) {
+		return true
+	}
+	return false
+}
+
+func (s *sqlSessionStore) Touch(sid string) error {
+	res, err := s.db.Exec(s.touchSQL, time.Now(), sid)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+func (s *sqlSessionStore) Delete(sid string) error {
+	_, err := s.db.Exec(s.deleteSQL, sid)
+	return err
+}
+
+func (s *sqlSessionStore) DeleteByUsername(username string) error {
+	_, err := s.db.Exec(s.deleteByUsernameSQL, username)
+	return err
+}
+
+// Close 停止后台回收 goroutine，供测试与优雅退出使用。
+func (s *sqlSessionStore) Close() error {
+	close(s.closeCh)
+	return nil
+}
+
+func (s *sqlSessionStore) reapLoop() {
+	if s.policy.MaxIdle == 0 && s.policy.MaxLifetime == 0 {
+		return
+	}
+
+	ticker := time.NewTicker(s.reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.closeCh:
+			return
+		case <-ticker.C:
+			if err := s.reapExpired(); err != nil {
+				log.Println("sso: reap expired sessions failed -", err)
+			}
+		}
+	}
+}
+
+func (s *sqlSessionStore) reapExpired() error {
+	now := time.Now()
+	if s.policy.MaxIdle > 0 {
+		if _, err := s.db.Exec(s.reapIdleSQL, now.Add(-s.policy.MaxIdle)); err != nil {
+			return err
+		}
+	}
+	if s.policy.MaxLifetime > 0 {
+		if _, err := s.db.Exec(s.reapLifetimeSQL, now.Add(-s.policy.MaxLifetime)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,340 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/GehirnInc/crypt"
+	_ "github.com/GehirnInc/crypt/apr1_crypt"
+	_ "github.com/GehirnInc/crypt/md5_crypt"
+	_ "github.com/GehirnInc/crypt/sha256_crypt"
+	_ "github.com/GehirnInc/crypt/sha512_crypt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+// SigningMethod 定义了密码的校验与生成方式，实现者既可以是简单的明文比较，
+// 也可以是 bcrypt/argon2id/scrypt 这样带参数、带盐的算法。
+type SigningMethod interface {
+	// Verify 使用 key 对 password 与 hash 进行校验，返回 nil 表示匹配成功，
+	// 密码不匹配时返回 ErrSignatureInvalid。
+	Verify(password, hash string, key []byte) error
+
+	// Hash 对 password 进行编码，生成该算法下可直接存入用户表的规范编码串。
+	Hash(password string, key []byte) (string, error)
+}
+
+var (
+	signingMethodsMu sync.RWMutex
+	signingMethods   = map[string]SigningMethod{}
+
+	// hashPrefixes 按照 stored hash 的前缀识别应使用的算法，用于在没有显式配置
+	// passwordHashAlg 时自动识别用户表中已有的各种密码格式。
+	hashPrefixes = []struct {
+		prefix string
+		name   string
+	}{
+		{"$argon2id$", "argon2id"},
+		{"$2a$", "bcrypt"},
+		{"$2b$", "bcrypt"},
+		{"$2y$", "bcrypt"},
+		{"$scrypt$", "scrypt"},
+		{"$6$", "sha512crypt"},
+		{"$5$", "sha256crypt"},
+		{"$apr1$", "apr1"},
+		{"$1$", "md5crypt"},
+	}
+)
+
+// RegisterSigningMethod 注册一个新的 SigningMethod 实现，name 不区分大小写。
+func RegisterSigningMethod(name string, method SigningMethod) {
+	signingMethodsMu.Lock()
+	defer signingMethodsMu.Unlock()
+	signingMethods[strings.ToLower(name)] = method
+}
+
+// GetSigningMethod 按名称查找已注册的 SigningMethod，找不到时返回 nil。
+func GetSigningMethod(name string) SigningMethod {
+	signingMethodsMu.RLock()
+	defer signingMethodsMu.RUnlock()
+	return signingMethods[strings.ToLower(name)]
+}
+
+func init() {
+	RegisterSigningMethod("plain", methodPlain)
+	RegisterSigningMethod("bcrypt", methodBcrypt)
+	RegisterSigningMethod("argon2id", methodArgon2id)
+	RegisterSigningMethod("scrypt", methodScrypt)
+	RegisterSigningMethod("md5crypt", methodCrypt(crypt.MD5))
+	RegisterSigningMethod("apr1", methodCrypt(crypt.APR1))
+	RegisterSigningMethod("sha256crypt", methodCrypt(crypt.SHA256))
+	RegisterSigningMethod("sha512crypt", methodCrypt(crypt.SHA512))
+	RegisterSigningMethod("auto", methodDefault)
+}
+
+// methodDefault 是 passwordHashAlg 未配置时使用的缺省算法：依据 hash 前缀自动
+// 识别 bcrypt/argon2id/scrypt/crypt 系列，识别不了则退化为明文比较，以兼容历史数据。
+var methodDefault SigningMethod = &autoSigningMethod{}
+
+type autoSigningMethod struct{}
+
+func (m *autoSigningMethod) detect(hash string) SigningMethod {
+	for _, p := range hashPrefixes {
+		if strings.HasPrefix(hash, p.prefix) {
+			return GetSigningMethod(p.name)
+		}
+	}
+	return nil
+}
+
+func (m *autoSigningMethod) Verify(password, hash string, key []byte) error {
+	if sub := m.detect(hash); sub != nil {
+		return sub.Verify(password, hash, key)
+	}
+	return methodPlain.Verify(password, hash, key)
+}
+
+func (m *autoSigningMethod) Hash(password string, key []byte) (string, error) {
+	return methodBcrypt.Hash(password, key)
+}
+
+// plainSigningMethod 是历史遗留的明文密码比较，仅用于兼容未加密的旧数据，
+// 使用常数时间比较避免时序攻击。
+type plainSigningMethod struct{}
+
+var methodPlain SigningMethod = &plainSigningMethod{}
+
+func (m *plainSigningMethod) Verify(password, hash string, key []byte) error {
+	if subtle.ConstantTimeCompare([]byte(password), []byte(hash)) != 1 {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (m *plainSigningMethod) Hash(password string, key []byte) (string, error) {
+	return password, nil
+}
+
+// bcryptSigningMethod 包装 golang.org/x/crypto/bcrypt，hash 编码形如 $2a$...。
+type bcryptSigningMethod struct {
+	cost int
+}
+
+var methodBcrypt SigningMethod = &bcryptSigningMethod{cost: bcrypt.DefaultCost}
+
+func (m *bcryptSigningMethod) Verify(password, hash string, key []byte) error {
+	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err != nil {
+		if err == bcrypt.ErrMismatchedHashAndPassword {
+			return ErrSignatureInvalid
+		}
+		return err
+	}
+	return nil
+}
+
+func (m *bcryptSigningMethod) Hash(password string, key []byte) (string, error) {
+	cost := m.cost
+	if len(key) > 0 {
+		if c, err := strconv.Atoi(string(key)); err == nil {
+			cost = c
+		}
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hashed), nil
+}
+
+// Argon2idParams 是 argon2id 的调参项，对应 config 里 passwordHashKey 的结构化配置。
+type Argon2idParams struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	KeyLen  uint32
+}
+
+var defaultArgon2idParams = Argon2idParams{
+	Time:    1,
+	Memory:  64 * 1024,
+	Threads: 4,
+	KeyLen:  32,
+}
+
+// argon2idSigningMethod 生成/校验 PHC 风格的编码串：
+// $argon2id$v=19$m=65536,t=1,p=4$<salt>$<hash>
+type argon2idSigningMethod struct {
+	params Argon2idParams
+}
+
+var methodArgon2id SigningMethod = &argon2idSigningMethod{params: defaultArgon2idParams}
+
+// NewArgon2idSigningMethod 使用自定义参数构造一个 argon2id SigningMethod，
+// 供 passwordHashKey 配置了 time/memory/threads/keyLen 时使用。
+func NewArgon2idSigningMethod(params Argon2idParams) SigningMethod {
+	p := defaultArgon2idParams
+	if params.Time != 0 {
+		p.Time = params.Time
+	}
+	if params.Memory != 0 {
+		p.Memory = params.Memory
+	}
+	if params.Threads != 0 {
+		p.Threads = params.Threads
+	}
+	if params.KeyLen != 0 {
+		p.KeyLen = params.KeyLen
+	}
+	return &argon2idSigningMethod{params: p}
+}
+
+func (m *argon2idSigningMethod) Hash(password string, key []byte) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	hash := argon2.IDKey([]byte(password), salt, m.params.Time, m.params.Memory, m.params.Threads, m.params.KeyLen)
+	return encodeArgon2id(m.params, salt, hash), nil
+}
+
+func (m *argon2idSigningMethod) Verify(password, hash string, key []byte) error {
+	params, salt, expected, err := decodeArgon2id(hash)
+	if err != nil {
+		return err
+	}
+	actual := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, uint32(len(expected)))
+	if subtle.ConstantTimeCompare(actual, expected) != 1 {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
+
+func encodeArgon2id(p Argon2idParams, salt, hash []byte) string {
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Time, p.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash))
+}
+
+func decodeArgon2id(encoded string) (Argon2idParams, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return Argon2idParams{}, nil, nil, errors.New("argon2id hash 格式不正确")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return Argon2idParams{}, nil, nil, errors.New("argon2id hash 版本不正确")
+	}
+
+	var p Argon2idParams
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Time, &p.Threads); err != nil {
+		return Argon2idParams{}, nil, nil, errors.New("argon2id hash 参数不正确")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return Argon2idParams{}, nil, nil, errors.New("argon2id hash salt 不正确")
+	}
+	sum, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return Argon2idParams{}, nil, nil, errors.New("argon2id hash 内容不正确")
+	}
+	return p, salt, sum, nil
+}
+
+// scryptSigningMethod 生成/校验形如 $scrypt$ln=15,r=8,p=1$<salt>$<hash> 的编码串。
+type scryptSigningMethod struct {
+	n, r, p, keyLen int
+}
+
+var methodScrypt SigningMethod = &scryptSigningMethod{n: 1 << 15, r: 8, p: 1, keyLen: 32}
+
+func (m *scryptSigningMethod) Hash(password string, key []byte) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	hash, err := scrypt.Key([]byte(password), salt, m.n, m.r, m.p, m.keyLen)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("$scrypt$ln=%d,r=%d,p=%d$%s$%s",
+		logBase2(m.n), m.r, m.p,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+func (m *scryptSigningMethod) Verify(password, hash string, key []byte) error {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 5 || parts[1] != "scrypt" {
+		return errors.New("scrypt hash 格式不正确")
+	}
+
+	var ln, r, p int
+	if _, err := fmt.Sscanf(parts[2], "ln=%d,r=%d,p=%d", &ln, &r, &p); err != nil {
+		return errors.New("scrypt hash 参数不正确")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return errors.New("scrypt hash salt 不正确")
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return errors.New("scrypt hash 内容不正确")
+	}
+
+	actual, err := scrypt.Key([]byte(password), salt, 1<<ln, r, p, len(expected))
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(actual, expected) != 1 {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
+
+func logBase2(n int) int {
+	l := 0
+	for n > 1 {
+		n >>= 1
+		l++
+	}
+	return l
+}
+
+// methodCrypt 包装 github.com/GehirnInc/crypt，支持 Unix crypt(3) 系的
+// $1$ (md5), $apr1$, $5$ (sha256), $6$ (sha512) 几种格式。
+type cryptSigningMethod struct {
+	id crypt.Crypter
+}
+
+func methodCrypt(id crypt.Crypt) SigningMethod {
+	return &cryptSigningMethod{id: crypt.New(id)}
+}
+
+func (m *cryptSigningMethod) Verify(password, hash string, key []byte) error {
+	if !crypt.IsHashSupported(hash) {
+		return errors.New("crypt hash 格式不支持")
+	}
+	c := crypt.NewFromHash(hash)
+	if err := c.Verify(hash, []byte(password)); err != nil {
+		if err == crypt.ErrKeyMismatch {
+			return ErrSignatureInvalid
+		}
+		return err
+	}
+	return nil
+}
+
+func (m *cryptSigningMethod) Hash(password string, key []byte) (string, error) {
+	return m.id.Generate([]byte(password), nil)
+}
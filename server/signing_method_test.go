@@ -0,0 +1,54 @@
+package server
+
+import "testing"
+
+func TestSigningMethodRoundTrip(t *testing.T) {
+	for _, name := range []string{"bcrypt", "argon2id", "scrypt", "md5crypt", "apr1", "sha256crypt", "sha512crypt"} {
+		t.Run(name, func(t *testing.T) {
+			method := GetSigningMethod(name)
+			if method == nil {
+				t.Fatalf("signing method %q isn't registered", name)
+			}
+
+			hash, err := method.Hash("correct horse battery staple", nil)
+			if err != nil {
+				t.Fatalf("Hash() failed - %s", err)
+			}
+
+			if err := method.Verify("correct horse battery staple", hash, nil); err != nil {
+				t.Fatalf("Verify() of the right password failed - %s", err)
+			}
+
+			err = method.Verify("wrong password", hash, nil)
+			if err != ErrSignatureInvalid {
+				t.Fatalf("Verify() of the wrong password = %v, want ErrSignatureInvalid", err)
+			}
+		})
+	}
+}
+
+func TestCryptVerifyUnsupportedHashDoesNotPanic(t *testing.T) {
+	method := GetSigningMethod("md5crypt")
+	if method == nil {
+		t.Fatal("md5crypt isn't registered")
+	}
+
+	if err := method.Verify("whatever", "not-a-valid-crypt-hash", nil); err == nil {
+		t.Fatal("Verify() of an unsupported hash format should return an error")
+	}
+}
+
+func TestAutoSigningMethodDetectsByPrefix(t *testing.T) {
+	hash, err := methodBcrypt.Hash("correct horse battery staple", nil)
+	if err != nil {
+		t.Fatalf("Hash() failed - %s", err)
+	}
+
+	if err := methodDefault.Verify("correct horse battery staple", hash, nil); err != nil {
+		t.Fatalf("auto Verify() of a bcrypt hash failed - %s", err)
+	}
+
+	if err := methodDefault.Verify("correct horse battery staple", "correct horse battery staple", nil); err != nil {
+		t.Fatalf("auto Verify() should fall back to plain text comparison for unrecognized hashes - %s", err)
+	}
+}
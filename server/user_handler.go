@@ -3,24 +3,41 @@ package server
 import (
 	"bytes"
 	"database/sql"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/netip"
 	"strings"
+	"sync"
 	"time"
 )
 
-// DefaultUserHandler 缺省 UserHandler
-var DefaultUserHandler = createDbUserHandler
+// DefaultUserHandler 缺省 UserHandler，依据 DbConfig.DbType 在 SQL 与 LDAP/AD
+// 两种后端之间分派：DbType == "ldap" 时走 createLdapUserHandler，其余沿用既
+// 有的 createDbUserHandler。
+var DefaultUserHandler = createUserHandler
 
+func createUserHandler(params interface{}) (UserHandler, error) {
+	config, ok := params.(*DbConfig)
+	if !ok {
+		return nil, errors.New("arguments of UserConfig isn't DbConfig")
+	}
+
+	if strings.EqualFold(config.DbType, "ldap") {
+		return createLdapUserHandler(config)
+	}
+	return createDbUserHandler(config)
+}
+
+// IPChecker 判断一个地址是否落在某个集合里，既可以是单个地址、一个地址区间，
+// 也可以是一个 netip.Prefix（CIDR），IPv4 与 IPv6 一视同仁。
 type IPChecker interface {
-	Contains(net.IP) bool
+	Contains(netip.Addr) bool
 }
 
-var _ IPChecker = &net.IPNet{}
+var _ IPChecker = netip.Prefix{}
 
 type User interface {
 	Name() string
@@ -37,6 +54,7 @@ type UserImpl struct {
 	lockedAt          time.Time
 	lockedTimeExpires time.Duration
 	blockIPList       []IPChecker
+	allowIPList       []IPChecker
 	data              map[string]interface{}
 }
 
@@ -53,34 +71,98 @@ const (
 	HeaderXRealIP       = "X-Real-IP"
 )
 
+var (
+	trustedProxiesMu sync.RWMutex
+	trustedProxies   []netip.Prefix
+)
+
+// SetTrustedProxies 配置可信的反向代理地址段。只有直连对端（req.RemoteAddr）
+// 落在这些地址段内时，RealIP 才会解析 X-Forwarded-For，并跳过其中同样落在
+// 这些地址段内的各跳；未配置时不信任任何对端，RealIP 直接返回 RemoteAddr，
+// 忽略 X-Forwarded-For/X-Real-IP。
+func SetTrustedProxies(cidrs []string) error {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, s := range cidrs {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, err2 := netip.ParseAddr(s)
+			if err2 != nil {
+				return fmt.Errorf("trusted proxy 地址不正确 - %s", s)
+			}
+			p = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, p)
+	}
+
+	trustedProxiesMu.Lock()
+	trustedProxies = prefixes
+	trustedProxiesMu.Unlock()
+	return nil
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	trustedProxiesMu.RLock()
+	defer trustedProxiesMu.RUnlock()
+
+	for _, p := range trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// RealIP 返回请求的真实来源地址。只有直接连过来的对端（req.RemoteAddr）本身
+// 就在 SetTrustedProxies 配置的可信代理地址段内时，才会去解析 X-Forwarded-For：
+// 按逗号分隔成一个列表，从左到右找到第一个不在可信代理地址段内的一跳并返回
+// 它。对端不可信时，直接忽略 X-Forwarded-For/X-Real-IP 并返回 RemoteAddr——
+// 否则一个直连的攻击者可以随意伪造这些头来冒充其它地址。
 func RealIP(req *http.Request) string {
-	ra := req.RemoteAddr
-	if ip := req.Header.Get(HeaderXForwardedFor); ip != "" {
-		ra = ip
-	} else if ip := req.Header.Get(HeaderXRealIP); ip != "" {
-		ra = ip
-	} else {
-		ra, _, _ = net.SplitHostPort(ra)
+	ra, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ra = req.RemoteAddr
+	}
+
+	peerAddr, err := netip.ParseAddr(ra)
+	if err != nil || !isTrustedProxy(peerAddr) {
+		return ra
+	}
+
+	if xff := req.Header.Get(HeaderXForwardedFor); xff != "" {
+		for _, hop := range strings.Split(xff, ",") {
+			hop = strings.TrimSpace(hop)
+			if hop == "" {
+				continue
+			}
+			addr, err := netip.ParseAddr(hop)
+			if err != nil {
+				continue
+			}
+			if !isTrustedProxy(addr) {
+				return hop
+			}
+		}
+	}
+
+	if ip := req.Header.Get(HeaderXRealIP); ip != "" {
+		return ip
 	}
+
 	return ra
 }
 
 func (u *UserImpl) CanUse(req *http.Request) (bool, error) {
-	if len(u.blockIPList) != 0 {
+	if len(u.blockIPList) != 0 || len(u.allowIPList) != 0 {
 		currentAddr := RealIP(req)
-		ip := net.ParseIP(currentAddr)
-		if ip == nil {
+		addr, err := netip.ParseAddr(currentAddr)
+		if err != nil {
 			return false, errors.New("client address is invalid - '" + currentAddr + "'")
 		}
 
-		blocked := true
-		for _, checker := range u.blockIPList {
-			if checker.Contains(ip) {
-				blocked = false
-				break
-			}
+		if len(u.blockIPList) != 0 && containsAddr(u.blockIPList, addr) {
+			return false, ErrUserIPBlocked
 		}
-		if blocked {
+		if len(u.allowIPList) != 0 && !containsAddr(u.allowIPList, addr) {
 			return false, ErrUserIPBlocked
 		}
 	}
@@ -95,42 +177,52 @@ func (u *UserImpl) CanUse(req *http.Request) (bool, error) {
 	return true, nil
 }
 
+func containsAddr(list []IPChecker, addr netip.Addr) bool {
+	for _, checker := range list {
+		if checker.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
 func (u *UserImpl) Data() map[string]interface{} {
 	return u.data
 }
 
+// ipRange 表示一个任意起止的地址区间（start 与 end 必须同为 IPv4 或同为
+// IPv6），用于 block_list/allow_list 里 "a-b" 这样的配置项。
 type ipRange struct {
-	start, end uint32
+	start, end netip.Addr
 }
 
-func (r *ipRange) Contains(ip net.IP) bool {
-	if ip.To4() == nil {
+func (r *ipRange) Contains(addr netip.Addr) bool {
+	if addr.Is4In6() {
+		addr = addr.Unmap()
+	}
+	if addr.Is4() != r.start.Is4() {
 		return false
 	}
-
-	v := binary.BigEndian.Uint32(ip.To4())
-	return r.start <= v || v <= r.end
+	return addr.Compare(r.start) >= 0 && addr.Compare(r.end) <= 0
 }
 
-func IPRange(start, end net.IP) (IPChecker, error) {
-	if start.To4() == nil {
-		return nil, errors.New("ip range 不支持 IPv6")
+func IPRange(start, end netip.Addr) (IPChecker, error) {
+	if start.Is4() != end.Is4() {
+		return nil, errors.New("ip range 的起止地址必须同为 IPv4 或同为 IPv6")
 	}
-	if end.To4() == nil {
-		return nil, errors.New("ip range 不支持 IPv6")
+	if end.Compare(start) < 0 {
+		return nil, errors.New("ip range 的起始地址必须不大于结束地址")
 	}
-	s := binary.BigEndian.Uint32(start.To4())
-	e := binary.BigEndian.Uint32(end.To4())
-	return &ipRange{start: s, end: e}, nil
+	return &ipRange{start: start, end: end}, nil
 }
 
 func IPRangeWith(start, end string) (IPChecker, error) {
-	s := net.ParseIP(start)
-	if s == nil {
+	s, err := netip.ParseAddr(start)
+	if err != nil {
 		return nil, errors.New(start + " is invalid address")
 	}
-	e := net.ParseIP(end)
-	if e == nil {
+	e, err := netip.ParseAddr(end)
+	if err != nil {
 		return nil, errors.New(end + " is invalid address")
 	}
 	return IPRange(s, e)
@@ -148,9 +240,17 @@ type dbUserHandler struct {
 	lockSQL           string
 	passwordName      string
 	blockIPList       string
+	allowIPList       string
 	lockedFieldName   string
 	lockedTimeExpires time.Duration
 	lockedTimeLayout  string
+
+	// retryPolicy 控制瞬时数据库错误（死锁、序列化失败、连接失效等）的重试。
+	// ReadUser 总是按 retryPolicy 重试；LockUser 只有在 lockSQL 是幂等语句
+	// （只是设置一个时间戳，重复执行无副作用）的前提下才能安全重试，因此受
+	// retryLockSQL 这个显式开关控制。
+	retryPolicy  RetryPolicy
+	retryLockSQL bool
 }
 
 func createDbUserHandler(params interface{}) (UserHandler, error) {
@@ -173,6 +273,7 @@ func createDbUserHandler(params interface{}) (UserHandler, error) {
 	lockedTimeExpires := time.Duration(0)
 	lockedTimeLayout := ""
 	blockIPList := ""
+	allowIPList := ""
 
 	if config.Params != nil {
 		if o, ok := config.Params["password"]; ok && o != nil {
@@ -195,6 +296,16 @@ func createDbUserHandler(params interface{}) (UserHandler, error) {
 			}
 		}
 
+		if o, ok := config.Params["allow_list"]; ok && o != nil {
+			s, ok := o.(string)
+			if !ok {
+				return nil, errors.New("数据库配置中的 allowIPList 的值不是字符串")
+			}
+			if s = strings.TrimSpace(s); s != "" {
+				allowIPList = s
+			}
+		}
+
 		if o, ok := config.Params["locked_at"]; ok && o != nil {
 			s, ok := o.(string)
 			if !ok {
@@ -255,11 +366,32 @@ func createDbUserHandler(params interface{}) (UserHandler, error) {
 		lockSQL = ReplacePlaceholders(lockSQL)
 	}
 
+	retryPolicy := DefaultRetryPolicy
+	retryLockSQL := false
+	if config.Params != nil {
+		policy, err := retryPolicyFromParams(config.Params)
+		if err != nil {
+			return nil, err
+		}
+		retryPolicy = policy
+
+		if o, ok := config.Params["retry_lock_sql"]; ok && o != nil {
+			b, ok := o.(bool)
+			if !ok {
+				return nil, errors.New("数据库配置中的 retry_lock_sql 的值不是布尔值")
+			}
+			retryLockSQL = b
+		}
+	}
+
 	return &dbUserHandler{
 		db:                db,
 		querySQL:          querySQL,
 		lockSQL:           lockSQL,
+		retryPolicy:       retryPolicy,
+		retryLockSQL:      retryLockSQL,
 		blockIPList:       blockIPList,
+		allowIPList:       allowIPList,
 		passwordName:      passwordName,
 		lockedFieldName:   lockedFieldName,
 		lockedTimeExpires: lockedTimeExpires,
@@ -301,50 +433,13 @@ func (ah *dbUserHandler) toUser(user string, data map[string]interface{}) (User,
 		}
 	}
 
-	var blockIPList []IPChecker
-	if o := data[ah.blockIPList]; o != nil {
-		s, ok := o.(string)
-		if !ok {
-			return nil, fmt.Errorf("value of '"+ah.blockIPList+"' isn't string - %T: %s", o, o)
-		}
-		var ipList []string
-		if err := json.Unmarshal([]byte(s), &ipList); err != nil {
-			return nil, fmt.Errorf("value of '"+ah.blockIPList+"' isn't []string - %s", o)
-		}
-
-		for _, s := range ipList {
-			s = strings.TrimSpace(s)
-			if s == "" {
-				continue
-			}
-			if strings.Contains(s, "-") {
-				ss := strings.Split(s, "-")
-				if len(ss) != 2 {
-					return nil, fmt.Errorf("value of '"+ah.blockIPList+"' isn't invalid ip range - %s", s)
-				}
-				checker, err := IPRangeWith(ss[0], ss[1])
-				if err != nil {
-					return nil, fmt.Errorf("value of '"+ah.blockIPList+"' isn't invalid ip range - %s", s)
-				}
-				blockIPList = append(blockIPList, checker)
-				continue
-			}
-
-			if strings.Contains(s, "/") {
-				_, cidr, err := net.ParseCIDR(s)
-				if err != nil {
-					return nil, fmt.Errorf("value of '"+ah.blockIPList+"' isn't invalid ip range - %s", s)
-				}
-				blockIPList = append(blockIPList, cidr)
-				continue
-			}
-
-			checker, err := IPRangeWith(s, s)
-			if err != nil {
-				return nil, fmt.Errorf("value of '"+ah.blockIPList+"' isn't invalid ip range - %s", s)
-			}
-			blockIPList = append(blockIPList, checker)
-		}
+	blockIPList, err := parseIPCheckerList(ah.blockIPList, data[ah.blockIPList])
+	if err != nil {
+		return nil, err
+	}
+	allowIPList, err := parseIPCheckerList(ah.allowIPList, data[ah.allowIPList])
+	if err != nil {
+		return nil, err
 	}
 
 	return &UserImpl{
@@ -353,74 +448,145 @@ func (ah *dbUserHandler) toUser(user string, data map[string]interface{}) (User,
 		lockedAt:          lockedAt,
 		lockedTimeExpires: ah.lockedTimeExpires,
 		blockIPList:       blockIPList,
+		allowIPList:       allowIPList,
 		data:              data,
 	}, nil
 }
 
-func (ah *dbUserHandler) ReadUser(username string) ([]User, error) {
-	rows, err := ah.db.Query(ah.querySQL, username)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, nil
-		}
-		return nil, err
+// parseIPCheckerList 解析形如 `["192.168.1.1", "10.0.0.1-10.0.0.255",
+// "2001:db8::/32"]` 的 JSON 字符串，field 仅用于出错时报出是哪个字段。
+func parseIPCheckerList(field string, o interface{}) ([]IPChecker, error) {
+	if o == nil {
+		return nil, nil
+	}
+	s, ok := o.(string)
+	if !ok {
+		return nil, fmt.Errorf("value of '"+field+"' isn't string - %T: %s", o, o)
+	}
+	var ipList []string
+	if err := json.Unmarshal([]byte(s), &ipList); err != nil {
+		return nil, fmt.Errorf("value of '"+field+"' isn't []string - %s", o)
 	}
 
-	var users []User
-	for rows.Next() {
-		columns, err := rows.Columns()
-		if err != nil {
-			return nil, err
-		}
-		var values = make([]interface{}, len(columns))
-		var valueRefs = make([]interface{}, len(columns))
-		for idx := range values {
-			valueRefs[idx] = &values[idx]
+	var checkers []IPChecker
+	for _, s := range ipList {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
 		}
-		err = rows.Scan(valueRefs...)
-		if nil != err {
-			return nil, err
+		if strings.Contains(s, "-") {
+			ss := strings.Split(s, "-")
+			if len(ss) != 2 {
+				return nil, fmt.Errorf("value of '"+field+"' isn't invalid ip range - %s", s)
+			}
+			checker, err := IPRangeWith(ss[0], ss[1])
+			if err != nil {
+				return nil, fmt.Errorf("value of '"+field+"' isn't invalid ip range - %s", s)
+			}
+			checkers = append(checkers, checker)
+			continue
 		}
 
-		user := map[string]interface{}{}
-		for idx, nm := range columns {
-			value := values[idx]
-			if bs, ok := value.([]byte); ok && bs != nil {
-				value = string(bs)
+		if strings.Contains(s, "/") {
+			prefix, err := netip.ParsePrefix(s)
+			if err != nil {
+				return nil, fmt.Errorf("value of '"+field+"' isn't invalid ip range - %s", s)
 			}
-			user[nm] = value
+			checkers = append(checkers, prefix)
+			continue
 		}
-		u, err := ah.toUser(username, user)
+
+		checker, err := IPRangeWith(s, s)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("value of '"+field+"' isn't invalid ip range - %s", s)
 		}
-		users = append(users, u)
+		checkers = append(checkers, checker)
 	}
-	if rows.Err() != nil {
-		if err != sql.ErrNoRows {
-			return nil, err
+	return checkers, nil
+}
+
+func (ah *dbUserHandler) ReadUser(username string) ([]User, error) {
+	var users []User
+	err := withRetry(ah.retryPolicy, func() error {
+		users = nil
+
+		rows, err := ah.db.Query(ah.querySQL, username)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return nil
+			}
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			columns, err := rows.Columns()
+			if err != nil {
+				return err
+			}
+			var values = make([]interface{}, len(columns))
+			var valueRefs = make([]interface{}, len(columns))
+			for idx := range values {
+				valueRefs[idx] = &values[idx]
+			}
+			err = rows.Scan(valueRefs...)
+			if nil != err {
+				return err
+			}
+
+			user := map[string]interface{}{}
+			for idx, nm := range columns {
+				value := values[idx]
+				if bs, ok := value.([]byte); ok && bs != nil {
+					value = string(bs)
+				}
+				user[nm] = value
+			}
+			u, err := ah.toUser(username, user)
+			if err != nil {
+				return err
+			}
+			users = append(users, u)
+		}
+		if rows.Err() != nil {
+			if err != sql.ErrNoRows {
+				return err
+			}
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return users, nil
 }
 
+// LockUser 执行 lockSQL，只设置 locked_at 之类的时间戳字段，是幂等操作，
+// 因此在 retryLockSQL 打开时可以安全地参与瞬时错误重试。
 func (ah *dbUserHandler) LockUser(username string) error {
 	if ah.lockSQL == "" {
 		return nil
 	}
 
-	res, err := ah.db.Exec(ah.lockSQL, time.Now(), username)
-	if err != nil {
-		return err
-	}
-	rowsAffected, err := res.RowsAffected()
-	if err != nil {
-		return err
+	policy := ah.retryPolicy
+	if !ah.retryLockSQL {
+		policy = RetryPolicy{MaxAttempts: 1}
 	}
-	if rowsAffected == 0 {
-		return errors.New("0 updated")
-	}
-	return nil
+
+	return withRetry(policy, func() error {
+		res, err := ah.db.Exec(ah.lockSQL, time.Now(), username)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return errors.New("0 updated")
+		}
+		return nil
+	})
 }
 
 func parseTime(layout, s string) time.Time {
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"net/http"
+	"net/netip"
+	"testing"
+)
+
+func mustAddr(t *testing.T, s string) netip.Addr {
+	t.Helper()
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		t.Fatalf("ParseAddr(%q) failed - %s", s, err)
+	}
+	return addr
+}
+
+func TestIPRangeContains(t *testing.T) {
+	v4, err := IPRangeWith("10.0.0.1", "10.0.0.10")
+	if err != nil {
+		t.Fatalf("IPRangeWith() failed - %s", err)
+	}
+	if !v4.Contains(mustAddr(t, "10.0.0.1")) {
+		t.Error("range should contain its start address")
+	}
+	if !v4.Contains(mustAddr(t, "10.0.0.10")) {
+		t.Error("range should contain its end address")
+	}
+	if !v4.Contains(mustAddr(t, "10.0.0.5")) {
+		t.Error("range should contain an address strictly between start and end")
+	}
+	if v4.Contains(mustAddr(t, "10.0.0.11")) {
+		t.Error("range should not contain an address past the end")
+	}
+	if v4.Contains(mustAddr(t, "10.0.0.0")) {
+		t.Error("range should not contain an address before the start")
+	}
+
+	v6, err := IPRangeWith("2001:db8::1", "2001:db8::ffff")
+	if err != nil {
+		t.Fatalf("IPRangeWith() failed - %s", err)
+	}
+	if !v6.Contains(mustAddr(t, "2001:db8::100")) {
+		t.Error("IPv6 range should contain an address strictly between start and end")
+	}
+	if v6.Contains(mustAddr(t, "2001:db8::1:0")) {
+		t.Error("IPv6 range should not contain an address past the end")
+	}
+}
+
+func TestIPRangeRejectsMixedFamily(t *testing.T) {
+	if _, err := IPRangeWith("10.0.0.1", "2001:db8::1"); err == nil {
+		t.Error("IPRangeWith() should reject a range mixing IPv4 and IPv6 addresses")
+	}
+}
+
+func TestUserImplCanUseBlockList(t *testing.T) {
+	blocked, err := IPRangeWith("6.6.6.6", "6.6.6.6")
+	if err != nil {
+		t.Fatalf("IPRangeWith() failed - %s", err)
+	}
+	u := &UserImpl{blockIPList: []IPChecker{blocked}}
+
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "6.6.6.6:12345"
+	if ok, err := u.CanUse(req); err != ErrUserIPBlocked || ok {
+		t.Fatalf("CanUse() for a blocked address = (%v, %v), want (false, ErrUserIPBlocked)", ok, err)
+	}
+
+	req.RemoteAddr = "8.8.8.8:12345"
+	if ok, err := u.CanUse(req); err != nil || !ok {
+		t.Fatalf("CanUse() for a non-blocked address = (%v, %v), want (true, nil)", ok, err)
+	}
+}
+
+func TestUserImplCanUseAllowList(t *testing.T) {
+	allowed, err := IPRangeWith("6.6.6.6", "6.6.6.6")
+	if err != nil {
+		t.Fatalf("IPRangeWith() failed - %s", err)
+	}
+	u := &UserImpl{allowIPList: []IPChecker{allowed}}
+
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "6.6.6.6:12345"
+	if ok, err := u.CanUse(req); err != nil || !ok {
+		t.Fatalf("CanUse() for an allow-listed address = (%v, %v), want (true, nil)", ok, err)
+	}
+
+	req.RemoteAddr = "8.8.8.8:12345"
+	if ok, err := u.CanUse(req); err != ErrUserIPBlocked || ok {
+		t.Fatalf("CanUse() for an address not on the allow list = (%v, %v), want (false, ErrUserIPBlocked)", ok, err)
+	}
+}
+
+func TestRealIPIgnoresForwardedForFromUntrustedPeer(t *testing.T) {
+	defer SetTrustedProxies(nil)
+
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "203.0.113.5:12345"
+	req.Header.Set(HeaderXForwardedFor, "1.2.3.4")
+
+	if got := RealIP(req); got != "203.0.113.5" {
+		t.Fatalf("RealIP() = %q, want the untrusted peer's own address %q", got, "203.0.113.5")
+	}
+}
+
+func TestRealIPHonorsForwardedForFromTrustedPeer(t *testing.T) {
+	defer SetTrustedProxies(nil)
+	if err := SetTrustedProxies([]string{"203.0.113.5/32"}); err != nil {
+		t.Fatalf("SetTrustedProxies() failed - %s", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "203.0.113.5:12345"
+	req.Header.Set(HeaderXForwardedFor, "1.2.3.4")
+
+	if got := RealIP(req); got != "1.2.3.4" {
+		t.Fatalf("RealIP() = %q, want the left-most hop %q", got, "1.2.3.4")
+	}
+}